@@ -0,0 +1,77 @@
+package conf
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// htmlToText renders htmlBody into a readable plain-text approximation for
+// mail clients and paging gateways that can't show HTML: tables collapse to
+// whitespace-separated cells, and links become "[text](url)" instead of
+// being dropped.
+func htmlToText(htmlBody string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(htmlBody))
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	renderText(&buf, doc)
+	return collapseBlankLines(buf.String()), nil
+}
+
+func renderText(buf *strings.Builder, n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		buf.WriteString(n.Data)
+	case html.ElementNode:
+		switch n.Data {
+		case "script", "style":
+			return
+		case "br":
+			buf.WriteString("\n")
+		case "a":
+			renderLink(buf, n)
+			return
+		case "tr":
+			defer buf.WriteString("\n")
+		case "td", "th":
+			defer buf.WriteString("\t")
+		case "p", "div", "table", "li", "h1", "h2", "h3", "h4", "h5", "h6":
+			defer buf.WriteString("\n")
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		renderText(buf, c)
+	}
+}
+
+func renderLink(buf *strings.Builder, n *html.Node) {
+	var href string
+	for _, a := range n.Attr {
+		if a.Key == "href" {
+			href = a.Val
+		}
+	}
+	var text strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		renderText(&text, c)
+	}
+	if href == "" || href == text.String() {
+		buf.WriteString(text.String())
+		return
+	}
+	fmt.Fprintf(buf, "[%s](%s)", text.String(), href)
+}
+
+var blankLines = regexp.MustCompile(`\n{3,}`)
+
+func collapseBlankLines(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t")
+	}
+	return strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
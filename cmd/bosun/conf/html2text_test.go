@@ -0,0 +1,100 @@
+package conf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHtmlToTextStripsScriptAndStyle(t *testing.T) {
+	in := `<html><head><style>body { color: red; }</style></head>
+<body><script>alert("hi")</script><p>hello</p></body></html>`
+	out, err := htmlToText(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "color: red") {
+		t.Errorf("htmlToText did not strip <style> content: %q", out)
+	}
+	if strings.Contains(out, "alert") {
+		t.Errorf("htmlToText did not strip <script> content: %q", out)
+	}
+	if !strings.Contains(out, "hello") {
+		t.Errorf("htmlToText dropped visible text: %q", out)
+	}
+}
+
+func TestHtmlToTextRendersLinks(t *testing.T) {
+	in := `<a href="https://example.com/graph">graph</a>`
+	out, err := htmlToText(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[graph](https://example.com/graph)"
+	if !strings.Contains(out, want) {
+		t.Errorf("htmlToText(%q) = %q, want substring %q", in, out, want)
+	}
+}
+
+func TestHtmlToTextLinkWithoutSeparateText(t *testing.T) {
+	in := `<a href="https://example.com">https://example.com</a>`
+	out, err := htmlToText(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "](") {
+		t.Errorf("htmlToText(%q) = %q, expected bare URL when link text equals href", in, out)
+	}
+	if !strings.Contains(out, "https://example.com") {
+		t.Errorf("htmlToText(%q) = %q, want the URL to still appear", in, out)
+	}
+}
+
+func TestHtmlToTextCollapsesTableCells(t *testing.T) {
+	in := `<table><tr><td>alert</td><td>crit</td></tr><tr><td>host</td><td>web01</td></tr></table>`
+	out, err := htmlToText(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("htmlToText(%q) = %q, want 2 rows, got %d", in, out, len(lines))
+	}
+	if !strings.Contains(lines[0], "alert") || !strings.Contains(lines[0], "crit") {
+		t.Errorf("row 0 = %q, want both cells present", lines[0])
+	}
+	if !strings.Contains(lines[1], "host") || !strings.Contains(lines[1], "web01") {
+		t.Errorf("row 1 = %q, want both cells present", lines[1])
+	}
+}
+
+// TestHtmlToTextDefaultAlertTemplate exercises htmlToText against
+// defaultAlertEmailBody (see notify_test.go), which mirrors the table/graph
+// image/dashboard-link combination Bosun's real default alert template
+// renders, so a regression specific to that combination is caught here
+// rather than only against single-feature snippets.
+func TestHtmlToTextDefaultAlertTemplate(t *testing.T) {
+	out, err := htmlToText(defaultAlertEmailBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "host\tweb01") {
+		t.Errorf("htmlToText(defaultAlertEmailBody) = %q, want the tag table's host row collapsed to a tab-separated line", out)
+	}
+	if !strings.Contains(out, "[View on Bosun](http://bosun.example.com/host?time=1h)") {
+		t.Errorf("htmlToText(defaultAlertEmailBody) = %q, want the dashboard link rendered", out)
+	}
+	if strings.Contains(out, "<img") || strings.Contains(out, "cid:") {
+		t.Errorf("htmlToText(defaultAlertEmailBody) = %q, want the graph image tag dropped, not leaked as raw markup", out)
+	}
+}
+
+func TestHtmlToTextCollapsesBlankLines(t *testing.T) {
+	in := `<p>one</p><p></p><p></p><p>two</p>`
+	out, err := htmlToText(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "\n\n\n") {
+		t.Errorf("htmlToText(%q) = %q, want runs of blank lines collapsed", in, out)
+	}
+}
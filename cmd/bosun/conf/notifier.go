@@ -0,0 +1,225 @@
+package conf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"bosun.org/metadata"
+	"bosun.org/models"
+	"bosun.org/util"
+)
+
+func init() {
+	metadata.AddMetricMeta(
+		"bosun.notification.sent", metadata.Counter, metadata.PerSecond,
+		"The number of notifications sent by Bosun, by transport.")
+	metadata.AddMetricMeta(
+		"bosun.notification.sent_failed", metadata.Counter, metadata.PerSecond,
+		"The number of notifications that Bosun failed to send, by transport.")
+}
+
+// Notifier is a pluggable outbound transport that Notify fans an incident
+// out to in addition to the built-in Email/Post/Get/Print mechanisms. A
+// Notification's transport settings (e.g. SlackURL) select, by scheme name,
+// the builder in the notifier registry that turns it into one.
+type Notifier interface {
+	Name() string
+	Send(ctx context.Context, st *models.IncidentState, c *Conf) error
+}
+
+// NotifierBuilder parses the scheme-specific parts of a notifier's
+// configuration into a Notifier.
+type NotifierBuilder func(n *Notification) (Notifier, error)
+
+var notifierRegistry = map[string]NotifierBuilder{}
+
+// RegisterNotifier makes a Notifier builder available under scheme, so that
+// notification blocks naming that scheme (e.g. `slack_url = "..."`) build an
+// instance of it. Built-in transports register themselves from init().
+// Notify only selects a scheme that hasTransport recognizes ("slack",
+// "pagerduty", "webhook"); a builder registered under any other scheme is
+// never selected by Notify.
+func RegisterNotifier(scheme string, build NotifierBuilder) {
+	notifierRegistry[scheme] = build
+}
+
+func init() {
+	RegisterNotifier("slack", newSlackNotifier)
+	RegisterNotifier("pagerduty", newPagerDutyNotifier)
+	RegisterNotifier("webhook", newWebhookNotifier)
+}
+
+// hasTransport reports whether n carries configuration for the named
+// transport scheme.
+func (n *Notification) hasTransport(scheme string) bool {
+	switch scheme {
+	case "slack":
+		return n.SlackURL != ""
+	case "pagerduty":
+		return n.PagerDutyRoutingKey != ""
+	case "webhook":
+		return n.WebhookURL != ""
+	}
+	return false
+}
+
+// slackNotifier posts to the Slack chat.postMessage-style incoming webhook
+// at url, coloring the attachment by the incident's current status.
+type slackNotifier struct {
+	url     string
+	channel string
+}
+
+func newSlackNotifier(n *Notification) (Notifier, error) {
+	if n.SlackURL == "" {
+		return nil, fmt.Errorf("slack_url is required")
+	}
+	return &slackNotifier{url: n.SlackURL, channel: n.SlackChannel}, nil
+}
+
+func (s *slackNotifier) Name() string { return "slack" }
+
+func (s *slackNotifier) Send(ctx context.Context, st *models.IncidentState, c *Conf) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"channel": s.channel,
+		"attachments": []map[string]interface{}{{
+			"color": slackColor(st.CurrentStatus),
+			"title": st.Subject,
+			"text":  st.Body,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return newHTTPStatusError(resp)
+	}
+	return nil
+}
+
+func slackColor(status models.Status) string {
+	switch status {
+	case models.StCritical:
+		return "danger"
+	case models.StWarning:
+		return "warning"
+	default:
+		return "good"
+	}
+}
+
+// pagerDutyNotifier drives the PagerDuty Events API v2, triggering or
+// resolving an incident keyed by dedup_key = st.AlertKey.
+type pagerDutyNotifier struct {
+	routingKey string
+}
+
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+func newPagerDutyNotifier(n *Notification) (Notifier, error) {
+	if n.PagerDutyRoutingKey == "" {
+		return nil, fmt.Errorf("pagerduty routing key is required")
+	}
+	return &pagerDutyNotifier{routingKey: n.PagerDutyRoutingKey}, nil
+}
+
+func (p *pagerDutyNotifier) Name() string { return "pagerduty" }
+
+func (p *pagerDutyNotifier) Send(ctx context.Context, st *models.IncidentState, c *Conf) error {
+	eventAction := "trigger"
+	if st.CurrentStatus == models.StNormal {
+		eventAction = "resolve"
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"routing_key":  p.routingKey,
+		"event_action": eventAction,
+		"dedup_key":    string(st.AlertKey),
+		"payload": map[string]interface{}{
+			"summary":  st.Subject,
+			"source":   util.Hostname,
+			"severity": pagerDutySeverity(st.CurrentStatus),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, pagerDutyEventsURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return newHTTPStatusError(resp)
+	}
+	return nil
+}
+
+func pagerDutySeverity(status models.Status) string {
+	switch status {
+	case models.StCritical:
+		return "critical"
+	case models.StWarning:
+		return "warning"
+	default:
+		return "info"
+	}
+}
+
+// webhookNotifier posts the full IncidentState as JSON to a generic url,
+// for consumers that want everything Bosun knows about the incident.
+// encoding/json already sorts map keys and renders time.Time as RFC3339, so
+// the payload is stable across repeated marshals of the same incident.
+type webhookNotifier struct {
+	url string
+}
+
+func newWebhookNotifier(n *Notification) (Notifier, error) {
+	if n.WebhookURL == "" {
+		return nil, fmt.Errorf("webhook url is required")
+	}
+	return &webhookNotifier{url: n.WebhookURL}, nil
+}
+
+func (w *webhookNotifier) Name() string { return "webhook" }
+
+func (w *webhookNotifier) Send(ctx context.Context, st *models.IncidentState, c *Conf) error {
+	payload, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return newHTTPStatusError(resp)
+	}
+	return nil
+}
@@ -2,47 +2,149 @@ package conf
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/mail"
-	"net/smtp"
 	"strings"
+	"time"
 
 	"bosun.org/collect"
-	"bosun.org/metadata"
 	"bosun.org/models"
+	"bosun.org/opentsdb"
 	"bosun.org/slog"
 	"bosun.org/util"
+	"github.com/emersion/go-sasl"
+	smtp "github.com/emersion/go-smtp"
 	"github.com/jordan-wright/email"
 )
 
-func init() {
-	metadata.AddMetricMeta(
-		"bosun.email.sent", metadata.Counter, metadata.PerSecond,
-		"The number of email notifications sent by Bosun.")
-	metadata.AddMetricMeta(
-		"bosun.email.sent_failed", metadata.Counter, metadata.PerSecond,
-		"The number of email notifications that Bosun failed to send.")
+// DefaultNotificationTimeout bounds how long a single notification dispatch
+// (SMTP session or HTTP request) may run before it is canceled, unless a
+// notification overrides it with its own Timeout.
+const DefaultNotificationTimeout = 30 * time.Second
+
+// timeout returns n's configured per-notification timeout, or
+// DefaultNotificationTimeout if none is set.
+func (n *Notification) timeout() time.Duration {
+	if n.Timeout > 0 {
+		return n.Timeout
+	}
+	return DefaultNotificationTimeout
+}
+
+// The transport names of the Email/Post/Get dispatchers that ship with
+// Notification itself, as opposed to ones resolved through
+// the notifierRegistry.
+const (
+	transportEmail = "email"
+	transportPost  = "post"
+	transportGet   = "get"
+)
+
+// Notify dispatches st through every transport n has configured. ctx should
+// be the server's shutdown context: canceling it stops new sends from being
+// started, but a send already in flight is not aborted by it — it drains on
+// its own per-notification timeout instead. Every send is routed through
+// c.NotificationQueue so a transient failure is retried and survives a
+// restart; if no queue is configured, Notify falls back to a single
+// best-effort attempt.
+func (n *Notification) Notify(ctx context.Context, st *models.IncidentState, c *Conf) {
+	if n.Print {
+		if n.UseBody {
+			go n.DoPrint("Subject: " + st.Subject + ", Body: " + st.Body)
+		} else {
+			go n.DoPrint(st.Subject)
+		}
+	}
+	for _, transport := range n.transports() {
+		n.dispatch(ctx, transport, st, c)
+	}
 }
 
-func (n *Notification) Notify(st *models.IncidentState, c *Conf) {
+// transports lists the scheme names of every transport n has configured,
+// covering both the built-in Email/Post/Get dispatchers and anything
+// resolved through the notifierRegistry (Slack, PagerDuty, webhook, ...).
+func (n *Notification) transports() []string {
+	var out []string
 	if len(n.Email) > 0 {
-		go n.DoEmail(st, c)
+		out = append(out, transportEmail)
 	}
 	if n.Post != nil {
-		go n.DoPost(st)
+		out = append(out, transportPost)
 	}
 	if n.Get != nil {
-		go n.DoGet(string(st.AlertKey))
+		out = append(out, transportGet)
 	}
-	if n.Print {
-		if n.UseBody {
-			go n.DoPrint("Subject: " + st.Subject + ", Body: " + st.Body)
-		} else {
-			go n.DoPrint(st.Subject)
+	for scheme := range notifierRegistry {
+		if n.hasTransport(scheme) {
+			out = append(out, scheme)
+		}
+	}
+	return out
+}
+
+// notifierFor resolves transport to the Notifier that implements it.
+func (n *Notification) notifierFor(transport string) (Notifier, error) {
+	switch transport {
+	case transportEmail:
+		return &emailNotifier{n: n}, nil
+	case transportPost:
+		return &postNotifier{n: n}, nil
+	case transportGet:
+		return &getNotifier{n: n}, nil
+	default:
+		build, ok := notifierRegistry[transport]
+		if !ok {
+			return nil, fmt.Errorf("unknown notification transport %q", transport)
+		}
+		return build(n)
+	}
+}
+
+// dispatch enqueues transport's send onto c.NotificationQueue, or runs it
+// once in the background if no queue has been wired up.
+func (n *Notification) dispatch(ctx context.Context, transport string, st *models.IncidentState, c *Conf) {
+	if c.NotificationQueue != nil {
+		if err := c.NotificationQueue.Enqueue(n.Name, transport, st); err != nil {
+			slog.Errorf("notification queue: failed to enqueue %s for alert %v: %v", transport, st.AlertKey, err)
 		}
+		return
+	}
+	if ctx.Err() != nil {
+		slog.Errorf("%s notification not sent for alert %v: %v", transport, st.AlertKey, ctx.Err())
+		return
+	}
+	go n.sendOnce(ctx, transport, st, c)
+}
+
+// sendOnce resolves and runs transport's Notifier a single time, recording
+// the generalized bosun.notification.sent{,_failed} metrics. The send is
+// bounded by n.timeout(), not by ctx's own cancellation: context.WithoutCancel
+// keeps any values ctx carries while dropping its Done channel, so a
+// shutdown signal on ctx lets this send finish instead of aborting it
+// mid-flight.
+func (n *Notification) sendOnce(ctx context.Context, transport string, st *models.IncidentState, c *Conf) {
+	ts := opentsdb.TagSet{"transport": transport}
+	nt, err := n.notifierFor(transport)
+	if err == nil {
+		sendCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), n.timeout())
+		err = nt.Send(sendCtx, st, c)
+		cancel()
+	}
+	if err != nil {
+		collect.Add("notification.sent_failed", ts, 1)
+		slog.Errorf("%s notification failed for alert %v: %v", transport, st.AlertKey, err)
+		return
 	}
+	collect.Add("notification.sent", ts, 1)
+	slog.Infof("%s notification successful for alert %v", transport, st.AlertKey)
 }
 
 func (n *Notification) GetPayload(subject, body string) (payload []byte) {
@@ -57,9 +159,62 @@ func (n *Notification) DoPrint(payload string) {
 	slog.Infoln(payload)
 }
 
-func (n *Notification) DoPost(st *models.IncidentState) {
+// DoEmail, DoPost, and DoGet send a single one-shot attempt via the
+// corresponding transport, bypassing c.NotificationQueue. Notify is the
+// normal entry point; these remain for callers that want a synchronous,
+// unretried send (e.g. an admin "test this notification" action).
+func (n *Notification) DoEmail(ctx context.Context, st *models.IncidentState, c *Conf) {
+	n.sendOnce(ctx, transportEmail, st, c)
+}
+
+func (n *Notification) DoPost(ctx context.Context, st *models.IncidentState, c *Conf) {
+	n.sendOnce(ctx, transportPost, st, c)
+}
+
+func (n *Notification) DoGet(ctx context.Context, st *models.IncidentState, c *Conf) {
+	n.sendOnce(ctx, transportGet, st, c)
+}
+
+// postNotifier is the transportPost Notifier: it renders n.Body (if any)
+// against the incident and POSTs the result to n.Post, signing it and
+// attaching any configured headers/mTLS client cert.
+type postNotifier struct{ n *Notification }
+
+func (p *postNotifier) Name() string { return transportPost }
+
+func (p *postNotifier) Send(ctx context.Context, st *models.IncidentState, c *Conf) error {
+	n := p.n
+	req, err := n.buildPostRequest(st)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	client := &http.Client{Timeout: n.timeout()}
+	tlsConfig, err := c.clientTLSConfig()
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return newHTTPStatusError(resp)
+	}
+	return nil
+}
+
+// buildPostRequest renders n.Body (if configured) against st and builds the
+// *http.Request for transportPost, including headers and HMAC signature.
+// It does not set a context; callers attach one before sending.
+func (n *Notification) buildPostRequest(st *models.IncidentState) (*http.Request, error) {
 	payload := n.GetPayload(st.Subject, st.Body)
-	ak := string(st.AlertKey)
 
 	if n.Body != nil {
 		var context interface{}
@@ -70,68 +225,131 @@ func (n *Notification) DoPost(st *models.IncidentState) {
 		}
 		buf := new(bytes.Buffer)
 		if err := n.Body.Execute(buf, context); err != nil {
-			slog.Errorln(err)
-			return
+			return nil, err
 		}
 		payload = buf.Bytes()
 	}
-	resp, err := http.Post(n.Post.String(), n.ContentType, bytes.NewBuffer(payload))
-	if resp != nil && resp.Body != nil {
-		defer resp.Body.Close()
+
+	contentType := n.ContentType
+	if contentType == "" && n.UseFullContext {
+		contentType = "application/json"
 	}
+
+	req, err := http.NewRequest(http.MethodPost, n.Post.String(), bytes.NewBuffer(payload))
 	if err != nil {
-		slog.Error(err)
-		return
+		return nil, err
 	}
-	if resp.StatusCode >= 300 {
-		slog.Errorln("bad response on notification post:", resp.Status)
-	} else {
-		slog.Infof("post notification successful for alert %s. Response code %d.", ak, resp.StatusCode)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for k, v := range n.Headers {
+		req.Header.Set(k, v)
 	}
+	if n.HMACSigningSecret != "" {
+		req.Header.Set("X-Bosun-Signature", "sha256="+hmacHexDigest(n.HMACSigningSecret, payload))
+	}
+	return req, nil
 }
 
-func (n *Notification) DoGet(ak string) {
-	resp, err := http.Get(n.Get.String())
+// hmacHexDigest returns the hex-encoded HMAC-SHA256 of payload under secret,
+// the convention GitHub, Stripe, and Mattermost use to verify webhook bodies.
+func hmacHexDigest(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// clientTLSConfig builds an mTLS client certificate config from c's
+// ClientCertFile/ClientKeyFile, or returns nil if neither is configured.
+func (c *Conf) clientTLSConfig() (*tls.Config, error) {
+	if c.ClientCertFile == "" && c.ClientKeyFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
 	if err != nil {
-		slog.Error(err)
-		return
+		return nil, fmt.Errorf("loading client TLS cert/key: %v", err)
 	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// getNotifier is the transportGet Notifier: it makes a bare GET to n.Get.
+type getNotifier struct{ n *Notification }
+
+func (g *getNotifier) Name() string { return transportGet }
+
+func (g *getNotifier) Send(ctx context.Context, st *models.IncidentState, c *Conf) error {
+	n := g.n
+	req, err := http.NewRequest(http.MethodGet, n.Get.String(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	client := &http.Client{Timeout: n.timeout()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 	if resp.StatusCode >= 300 {
-		slog.Error("bad response on notification get:", resp.Status)
-	} else {
-		slog.Infof("get notification successful for alert %s. Response code %d.", ak, resp.StatusCode)
+		return newHTTPStatusError(resp)
+	}
+	return nil
+}
+
+// emailNotifier is the transportEmail Notifier.
+type emailNotifier struct{ n *Notification }
+
+func (e *emailNotifier) Name() string { return transportEmail }
+
+func (e *emailNotifier) Send(ctx context.Context, st *models.IncidentState, c *Conf) error {
+	msg, err := e.n.buildEmail(st, c)
+	if err != nil {
+		return err
 	}
+	return Send(ctx, msg, c)
 }
 
-func (n *Notification) DoEmail(st *models.IncidentState, c *Conf) {
+// buildEmail renders st into the *email.Email transportEmail sends,
+// choosing an HTML, plain-text, or multipart/alternative body per n and c's
+// plain-text settings, and attaching st's attachments.
+func (n *Notification) buildEmail(st *models.IncidentState, c *Conf) (*email.Email, error) {
 	e := email.NewEmail()
 	e.From = c.EmailFrom
 	for _, a := range n.Email {
 		e.To = append(e.To, a.Address)
 	}
 	e.Subject = string(st.EmailSubject)
-	e.HTML = st.EmailBody
+	if n.PlainTextOnly || c.MailService.UsePlainText {
+		text, err := htmlToText(string(st.EmailBody))
+		if err != nil {
+			return nil, err
+		}
+		e.Text = []byte(text)
+	} else {
+		e.HTML = st.EmailBody
+		if c.MailService.AddPlainTextAlt {
+			text, err := htmlToText(string(st.EmailBody))
+			if err != nil {
+				return nil, err
+			}
+			e.Text = []byte(text)
+		}
+	}
 	if st.Attachments != nil {
 		for _, a := range st.Attachments {
 			e.Attach(bytes.NewBuffer(a.Data), a.Filename, a.ContentType)
 		}
 	}
-	ak := string(st.AlertKey)
 	e.Headers.Add("X-Bosun-Server", util.Hostname)
-	if err := Send(e, c.SMTPHost, c.SMTPUsername, c.SMTPPassword); err != nil {
-		collect.Add("email.sent_failed", nil, 1)
-		slog.Errorf("failed to send alert %v to %v %v\n", ak, e.To, err)
-		return
-	}
-	collect.Add("email.sent", nil, 1)
-	slog.Infof("relayed alert %v to %v sucessfully. Subject: %d bytes. Body: %d bytes.", ak, e.To, len(st.EmailSubject), len(st.EmailBody))
+	return e, nil
 }
 
-// Send an email using the given host and SMTP auth (optional), returns any
-// error thrown by smtp.SendMail. This function merges the To, Cc, and Bcc
-// fields and calls the smtp.SendMail function using the Email.Bytes() output as
-// the message.
-func Send(e *email.Email, addr, username, password string) error {
+// Send an email using the SMTP settings on c, authenticating with whatever
+// mechanism c.SMTPAuthMechanism names (if any), and returns any error thrown
+// along the way. It merges the To, Cc, and Bcc fields and calls SendMail
+// using the Email.Bytes() output as the message.
+func Send(ctx context.Context, e *email.Email, c *Conf) error {
 	// Merge the To, Cc, and Bcc fields
 	to := make([]string, 0, len(e.To)+len(e.Cc)+len(e.Bcc))
 	to = append(append(append(to, e.To...), e.Cc...), e.Bcc...)
@@ -147,33 +365,103 @@ func Send(e *email.Email, addr, username, password string) error {
 	if err != nil {
 		return err
 	}
-	return SendMail(addr, username, password, from.Address, to, raw)
+	var token TokenSource
+	switch {
+	case c.SMTPXOAuth2Token != "":
+		token = StaticTokenSource(c.SMTPXOAuth2Token)
+	case c.SMTPXOAuth2TokenCommand != "":
+		fields := strings.Fields(c.SMTPXOAuth2TokenCommand)
+		if len(fields) == 0 {
+			return errors.New("SMTPXOAuth2TokenCommand is empty")
+		}
+		token = &ExecTokenSource{Command: fields[0], Args: fields[1:]}
+	}
+	return SendMail(ctx, c.SMTPHost, c.SMTPHelloName, c.SMTPStartTLS, c.SMTPTLS, c.SMTPInsecureSkipVerify, c.SMTPAuthMechanism, c.SMTPUsername, c.SMTPPassword, token, from.Address, to, raw)
 }
 
-// SendMail connects to the server at addr, switches to TLS if
-// possible, authenticates with the optional mechanism a if possible,
-// and then sends an email from address from, to addresses to, with
-// message msg.
-func SendMail(addr, username, password string, from string, to []string, msg []byte) error {
-	c, err := smtp.Dial(addr)
+// SMTPStartTLSMode controls whether and how SendMail upgrades a plaintext
+// SMTP connection to TLS via the STARTTLS extension.
+type SMTPStartTLSMode string
+
+const (
+	// SMTPStartTLSOff never attempts STARTTLS, even if the server advertises it.
+	SMTPStartTLSOff SMTPStartTLSMode = "off"
+	// SMTPStartTLSOpportunistic upgrades when the server advertises STARTTLS,
+	// but falls back to a plaintext session otherwise. This is the default.
+	SMTPStartTLSOpportunistic SMTPStartTLSMode = "opportunistic"
+	// SMTPStartTLSRequired fails the send if the server does not advertise STARTTLS.
+	SMTPStartTLSRequired SMTPStartTLSMode = "required"
+)
+
+// SendMail connects to the server at addr (using implicit TLS if implicitTLS
+// is set, i.e. SMTPS on port 465), optionally switches to TLS via STARTTLS
+// per startTLS, authenticates with the named mechanism ("plain", "login",
+// "cram-md5", "xoauth2", "none"/"" to skip auth), and then sends an email
+// from address from, to addresses to, with message msg. For xoauth2, token
+// is refreshed and the AUTH exchange retried once if the server reports a
+// 4xx auth failure. ctx bounds the dial and, for implicit TLS, the
+// handshake; ctx's deadline, if it has one, is also set on the connection so
+// it bounds the rest of the SMTP conversation. Canceling ctx is not
+// consulted once that conversation is underway.
+func SendMail(ctx context.Context, addr, helloName string, startTLS SMTPStartTLSMode, implicitTLS, insecureSkipVerify bool, mechanism, username, password string, token TokenSource, from string, to []string, msg []byte) error {
+	if helloName == "" {
+		helloName = "localhost"
+	}
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	tlsConfig := &tls.Config{ServerName: host, InsecureSkipVerify: insecureSkipVerify}
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return err
 	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	if implicitTLS {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
 	defer c.Close()
-	if err = c.Hello("localhost"); err != nil {
+
+	if err = c.Hello(helloName); err != nil {
 		return err
 	}
-	if ok, _ := c.Extension("STARTTLS"); ok {
-		if err = c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
-			return err
+
+	if !implicitTLS && startTLS != SMTPStartTLSOff {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err = c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		} else if startTLS == SMTPStartTLSRequired {
+			return fmt.Errorf("smtp: server %s does not support STARTTLS", addr)
 		}
-		if len(username) > 0 || len(password) > 0 {
-			hostWithoutPort := strings.Split(addr, ":")[0]
-			auth := smtp.PlainAuth("", username, password, hostWithoutPort)
-			c.Auth(auth)
+	}
+
+	if auth, err := saslClient(mechanism, username, password, token); err != nil {
+		return err
+	} else if auth != nil {
+		if err = authWithRetry(c, mechanism, auth, token); err != nil {
+			return err
 		}
 	}
-	if err = c.Mail(from); err != nil {
+
+	if err = c.Mail(from, nil); err != nil {
 		return err
 	}
 	for _, addr := range to {
@@ -185,13 +473,73 @@ func SendMail(addr, username, password string, from string, to []string, msg []b
 	if err != nil {
 		return err
 	}
-	_, err = w.Write(msg)
-	if err != nil {
+	if _, err = w.Write(msg); err != nil {
 		return err
 	}
-	err = w.Close()
-	if err != nil {
+	if err = w.Close(); err != nil {
 		return err
 	}
 	return c.Quit()
 }
+
+// authWithRetry runs the AUTH exchange, and for xoauth2 refreshes the token
+// and retries once if the server rejected it with a transient (4xx) failure,
+// per the Microsoft/Google XOAUTH2 convention.
+func authWithRetry(c *smtp.Client, mechanism string, auth sasl.Client, token TokenSource) error {
+	err := c.Auth(auth)
+	if err == nil || mechanism != "xoauth2" || !isAuthTemporaryFailure(err) {
+		return err
+	}
+	if _, rerr := token.Refresh(); rerr != nil {
+		return err
+	}
+	return c.Auth(auth)
+}
+
+func isAuthTemporaryFailure(err error) bool {
+	serr, ok := err.(*smtp.SMTPError)
+	return ok && serr.Code >= 400 && serr.Code < 500
+}
+
+// saslClient builds the go-sasl client for mechanism, or returns nil if
+// mechanism is empty/"none" and no authentication should be attempted.
+func saslClient(mechanism, username, password string, token TokenSource) (sasl.Client, error) {
+	switch strings.ToLower(mechanism) {
+	case "", "none":
+		return nil, nil
+	case "plain":
+		return sasl.NewPlainClient("", username, password), nil
+	case "login":
+		return sasl.NewLoginClient(username, password), nil
+	case "cram-md5":
+		return sasl.NewCramMD5Client(username, password), nil
+	case "xoauth2":
+		if token == nil {
+			return nil, errors.New("smtp: xoauth2 auth requires a token source")
+		}
+		return &xoauth2Client{username: username, token: token}, nil
+	default:
+		return nil, fmt.Errorf("smtp: unknown auth mechanism %q", mechanism)
+	}
+}
+
+// xoauth2Client implements sasl.Client for the XOAUTH2 mechanism used by
+// Office 365 and Gmail in place of basic auth.
+type xoauth2Client struct {
+	username string
+	token    TokenSource
+}
+
+func (x *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	tok, err := x.token.Token()
+	if err != nil {
+		return "", nil, err
+	}
+	return "XOAUTH2", []byte(fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", x.username, tok)), nil
+}
+
+func (x *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	// A non-empty challenge at this point is the server's JSON error blob;
+	// XOAUTH2 has no further exchange, so treat it as a failure.
+	return nil, fmt.Errorf("smtp: xoauth2 challenge after initial response: %s", challenge)
+}
@@ -0,0 +1,316 @@
+package conf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bosun.org/collect"
+	"bosun.org/metadata"
+	"bosun.org/models"
+	"bosun.org/opentsdb"
+	"bosun.org/slog"
+	"github.com/boltdb/bolt"
+)
+
+func init() {
+	metadata.AddMetricMeta(
+		"bosun.notification.queue_depth", metadata.Gauge, metadata.Count,
+		"The number of notifications waiting to be sent or retried.")
+	metadata.AddMetricMeta(
+		"bosun.notification.retries", metadata.Counter, metadata.PerSecond,
+		"The number of notification send attempts that were retried after a transient failure.")
+	metadata.AddMetricMeta(
+		"bosun.notification.dropped", metadata.Counter, metadata.PerSecond,
+		"The number of notifications dropped after exhausting their retry budget.")
+}
+
+var notificationQueueBucket = []byte("notificationQueue")
+
+// QueuedNotification is a notification dispatch pending in the
+// NotificationQueue, persisted so a restart doesn't lose in-flight work.
+// NotificationName resolves back to the *Notification (and therefore its
+// Slack/webhook/PagerDuty config, headers, secrets, ...) via
+// Conf.Notifications; Transport says which of that Notification's
+// transports this particular send is for.
+type QueuedNotification struct {
+	ID               string                `json:"id"`
+	NotificationName string                `json:"notification_name"`
+	Transport        string                `json:"transport"`
+	Incident         *models.IncidentState `json:"incident"`
+	// Attempt is the number of sends made so far; dispatch gives up once it
+	// reaches RetryPolicy.MaxAttempts.
+	Attempt     int       `json:"attempt"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// RetryPolicy bounds how a NotificationQueue backs off and gives up on a
+// failing transport.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy matches most webhook/SMTP providers' own retry
+// guidance: a handful of attempts over a few minutes.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 6,
+	BaseDelay:   5 * time.Second,
+	MaxDelay:    5 * time.Minute,
+}
+
+// next returns the delay before the retry that follows the attempt-th
+// (1-based) failed send, exponential with full jitter, capped at MaxDelay.
+func (p RetryPolicy) next(attempt int) time.Duration {
+	d := p.BaseDelay << uint(attempt-1)
+	if d <= 0 || d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// NotificationQueue is a bounded worker pool that dispatches queued
+// notifications, retrying retriable failures with exponential backoff and
+// spooling pending work to BoltDB so a Bosun restart resumes it.
+type NotificationQueue struct {
+	db      *bolt.DB
+	c       *Conf
+	policy  RetryPolicy
+	workers int
+
+	jobs   chan *QueuedNotification
+	depth  int64
+	wg     sync.WaitGroup
+	cancel context.CancelFunc
+}
+
+// NewNotificationQueue creates a queue backed by db (Bosun's existing bolt
+// store) with the given number of concurrent workers. Call Start to launch
+// the workers and resume anything spooled from a previous run.
+func NewNotificationQueue(db *bolt.DB, c *Conf, workers int) (*NotificationQueue, error) {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(notificationQueueBucket)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	q := &NotificationQueue{
+		db:      db,
+		c:       c,
+		policy:  DefaultRetryPolicy,
+		workers: workers,
+		jobs:    make(chan *QueuedNotification, 1024),
+	}
+	return q, nil
+}
+
+// Start launches the worker pool and requeues anything spooled from a prior
+// run. Canceling ctx (or calling Stop) stops workers from picking up new
+// jobs; a send already in flight is not interrupted by it and drains on its
+// own per-notification timeout instead.
+func (q *NotificationQueue) Start(ctx context.Context) error {
+	ctx, q.cancel = context.WithCancel(ctx)
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.worker(ctx)
+	}
+	return q.requeueSpooled()
+}
+
+// Stop stops the worker pool from picking up new jobs and waits for any
+// sends already in flight to finish on their own.
+func (q *NotificationQueue) Stop() {
+	if q.cancel != nil {
+		q.cancel()
+	}
+	q.wg.Wait()
+}
+
+// Enqueue spools a pending send of notificationName's transport and
+// schedules it for immediate dispatch.
+func (q *NotificationQueue) Enqueue(notificationName, transport string, st *models.IncidentState) error {
+	qn := &QueuedNotification{
+		ID:               fmt.Sprintf("%s-%s-%s-%d", notificationName, transport, string(st.AlertKey), time.Now().UnixNano()),
+		NotificationName: notificationName,
+		Transport:        transport,
+		Incident:         st,
+		NextAttempt:      time.Now(),
+	}
+	if err := q.spool(qn); err != nil {
+		return err
+	}
+	atomic.AddInt64(&q.depth, 1)
+	collect.Add("notification.queue_depth", nil, atomic.LoadInt64(&q.depth))
+	q.jobs <- qn
+	return nil
+}
+
+func (q *NotificationQueue) worker(ctx context.Context) {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case qn := <-q.jobs:
+			q.dispatch(ctx, qn)
+		}
+	}
+}
+
+func (q *NotificationQueue) dispatch(ctx context.Context, qn *QueuedNotification) {
+	ts := opentsdb.TagSet{"transport": qn.Transport}
+
+	// A notification no longer in the spool (removed by Cancel) is not sent.
+	var spooled bool
+	if err := q.db.View(func(tx *bolt.Tx) error {
+		spooled = tx.Bucket(notificationQueueBucket).Get([]byte(qn.ID)) != nil
+		return nil
+	}); err == nil && !spooled {
+		atomic.AddInt64(&q.depth, -1)
+		collect.Add("notification.queue_depth", nil, atomic.LoadInt64(&q.depth))
+		return
+	}
+
+	err := q.send(ctx, qn)
+	if err == nil {
+		collect.Add("notification.sent", ts, 1)
+		q.finish(qn)
+		return
+	}
+	collect.Add("notification.sent_failed", ts, 1)
+
+	qn.Attempt++
+
+	if !isRetriable(err) || qn.Attempt >= q.policy.MaxAttempts {
+		collect.Add("notification.dropped", ts, 1)
+		slog.Errorf("notification queue: giving up on %s after %d attempts: %v", qn.ID, qn.Attempt, err)
+		q.finish(qn)
+		return
+	}
+
+	qn.LastError = err.Error()
+	qn.NextAttempt = time.Now().Add(q.policy.next(qn.Attempt))
+	collect.Add("notification.retries", ts, 1)
+	if err := q.spool(qn); err != nil {
+		slog.Errorln(err)
+	}
+	time.AfterFunc(time.Until(qn.NextAttempt), func() {
+		select {
+		case q.jobs <- qn:
+		case <-ctx.Done():
+		}
+	})
+}
+
+// send resolves qn back to the *Notification that configured it (its
+// Slack/webhook/PagerDuty URL, headers, secrets, ...) and runs its
+// transport once. The send is bounded by n.timeout(), not by ctx's own
+// cancellation, so a Stop-triggered shutdown lets it finish on its own
+// instead of aborting it mid-flight; ctx is only consulted by the worker
+// loop to decide whether to start sends at all.
+func (q *NotificationQueue) send(ctx context.Context, qn *QueuedNotification) error {
+	n, ok := q.c.Notifications[qn.NotificationName]
+	if !ok {
+		return fmt.Errorf("notification queue: unknown notification %q", qn.NotificationName)
+	}
+	nt, err := n.notifierFor(qn.Transport)
+	if err != nil {
+		return err
+	}
+	sendCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), n.timeout())
+	defer cancel()
+	return nt.Send(sendCtx, qn.Incident, q.c)
+}
+
+func (q *NotificationQueue) finish(qn *QueuedNotification) {
+	if err := q.unspool(qn); err != nil {
+		slog.Errorln(err)
+	}
+	atomic.AddInt64(&q.depth, -1)
+	collect.Add("notification.queue_depth", nil, atomic.LoadInt64(&q.depth))
+}
+
+func (q *NotificationQueue) spool(qn *QueuedNotification) error {
+	data, err := json.Marshal(qn)
+	if err != nil {
+		return err
+	}
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(notificationQueueBucket).Put([]byte(qn.ID), data)
+	})
+}
+
+func (q *NotificationQueue) unspool(qn *QueuedNotification) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(notificationQueueBucket).Delete([]byte(qn.ID))
+	})
+}
+
+func (q *NotificationQueue) requeueSpooled() error {
+	var pending []*QueuedNotification
+	if err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(notificationQueueBucket).ForEach(func(k, v []byte) error {
+			var qn QueuedNotification
+			if err := json.Unmarshal(v, &qn); err != nil {
+				return nil
+			}
+			pending = append(pending, &qn)
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+	for _, qn := range pending {
+		atomic.AddInt64(&q.depth, 1)
+		q.jobs <- qn
+	}
+	collect.Add("notification.queue_depth", nil, atomic.LoadInt64(&q.depth))
+	return nil
+}
+
+// List returns the notifications currently spooled, for the admin endpoint.
+func (q *NotificationQueue) List() ([]*QueuedNotification, error) {
+	var out []*QueuedNotification
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(notificationQueueBucket).ForEach(func(k, v []byte) error {
+			var qn QueuedNotification
+			if err := json.Unmarshal(v, &qn); err != nil {
+				return err
+			}
+			out = append(out, &qn)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// Retry re-dispatches a spooled notification immediately, resetting its
+// backoff schedule.
+func (q *NotificationQueue) Retry(id string) error {
+	all, err := q.List()
+	if err != nil {
+		return err
+	}
+	for _, qn := range all {
+		if qn.ID == id {
+			qn.Attempt = 0
+			qn.NextAttempt = time.Now()
+			q.jobs <- qn
+			return nil
+		}
+	}
+	return fmt.Errorf("notification queue: no such id %s", id)
+}
+
+// Cancel removes a spooled notification without sending it.
+func (q *NotificationQueue) Cancel(id string) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(notificationQueueBucket).Delete([]byte(id))
+	})
+}
@@ -0,0 +1,129 @@
+package conf
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+
+	"bosun.org/models"
+)
+
+// defaultAlertEmailBody approximates the shape of Bosun's real default alert
+// template (defined in cmd/bosun/sched, which isn't part of this tree): a
+// status line, a tag/value table, an inline graph referenced as a cid:
+// attachment, and a link back to the Bosun dashboard. It exists so these
+// tests exercise the same table/graph/link combination the shipped template
+// renders, rather than an unrepresentative one-tag snippet.
+const defaultAlertEmailBody = `<p>web01 is critical: test.alert on host=web01</p>
+<table>
+<tr><th>Tag</th><th>Value</th></tr>
+<tr><td>host</td><td>web01</td></tr>
+<tr><td>alert</td><td>test.alert</td></tr>
+</table>
+<p><img src="cid:graph.png" alt="graph"/></p>
+<p><a href="http://bosun.example.com/host?time=1h">View on Bosun</a></p>`
+
+func testIncidentState() *models.IncidentState {
+	return &models.IncidentState{
+		AlertKey:     "test.alert{host=web01}",
+		EmailSubject: []byte("web01 is critical"),
+		EmailBody:    []byte(defaultAlertEmailBody),
+		Attachments: []*models.Attachment{
+			{Filename: "graph.png", ContentType: "image/png", Data: []byte("not a real png")},
+		},
+	}
+}
+
+func testNotification() *Notification {
+	addr, _ := mail.ParseAddress("oncall@example.com")
+	return &Notification{
+		Name:  "default",
+		Email: []*mail.Address{addr},
+	}
+}
+
+func TestBuildEmailHTMLWithAttachments(t *testing.T) {
+	n := testNotification()
+	c := &Conf{EmailFrom: "bosun@example.com"}
+	st := testIncidentState()
+
+	e, err := n.buildEmail(st, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.From != c.EmailFrom {
+		t.Errorf("From = %q, want %q", e.From, c.EmailFrom)
+	}
+	if len(e.To) != 1 || e.To[0] != "oncall@example.com" {
+		t.Errorf("To = %v, want [oncall@example.com]", e.To)
+	}
+	if e.Subject != string(st.EmailSubject) {
+		t.Errorf("Subject = %q, want %q", e.Subject, st.EmailSubject)
+	}
+	if string(e.HTML) != string(st.EmailBody) {
+		t.Errorf("HTML = %q, want %q", e.HTML, st.EmailBody)
+	}
+	if len(e.Text) != 0 {
+		t.Errorf("Text = %q, want empty unless AddPlainTextAlt is set", e.Text)
+	}
+	if len(e.Attachments) != 1 {
+		t.Fatalf("Attachments = %d, want 1", len(e.Attachments))
+	}
+}
+
+func TestBuildEmailAddsPlainTextAlt(t *testing.T) {
+	n := testNotification()
+	c := &Conf{EmailFrom: "bosun@example.com"}
+	c.MailService.AddPlainTextAlt = true
+	st := testIncidentState()
+
+	e, err := n.buildEmail(st, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.HTML) == 0 {
+		t.Error("HTML body should still be set when adding a plain-text alt")
+	}
+	if !strings.Contains(string(e.Text), "View on Bosun") {
+		t.Errorf("Text = %q, want the rendered plain-text alternative", e.Text)
+	}
+	if strings.Contains(string(e.Text), "<table>") {
+		t.Errorf("Text = %q, want HTML tags stripped", e.Text)
+	}
+}
+
+func TestBuildEmailPlainTextOnly(t *testing.T) {
+	n := testNotification()
+	n.PlainTextOnly = true
+	c := &Conf{EmailFrom: "bosun@example.com"}
+	st := testIncidentState()
+
+	e, err := n.buildEmail(st, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.HTML) != 0 {
+		t.Errorf("HTML = %q, want empty when PlainTextOnly is set", e.HTML)
+	}
+	if !strings.Contains(string(e.Text), "View on Bosun") {
+		t.Errorf("Text = %q, want the rendered plain-text body", e.Text)
+	}
+	if !strings.Contains(string(e.Text), "web01") {
+		t.Errorf("Text = %q, want the tag table's values preserved", e.Text)
+	}
+}
+
+func TestBuildEmailPlainTextOnlyFromMailService(t *testing.T) {
+	n := testNotification()
+	c := &Conf{EmailFrom: "bosun@example.com"}
+	c.MailService.UsePlainText = true
+	st := testIncidentState()
+
+	e, err := n.buildEmail(st, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.HTML) != 0 {
+		t.Errorf("HTML = %q, want empty when MailService.UsePlainText is set", e.HTML)
+	}
+}
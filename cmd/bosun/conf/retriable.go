@@ -0,0 +1,61 @@
+package conf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	smtp "github.com/emersion/go-smtp"
+)
+
+// httpStatusError records an HTTP response's status so isRetriable can tell
+// a permanent client error (4xx) from a transient server error (5xx).
+type httpStatusError struct {
+	status string
+	code   int
+}
+
+func newHTTPStatusError(resp *http.Response) *httpStatusError {
+	return &httpStatusError{status: resp.Status, code: resp.StatusCode}
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("bad response: %s", e.status)
+}
+
+// isRetriable classifies a Notifier.Send error as worth retrying: SMTP 4xx
+// and HTTP 5xx/429 responses are treated as transient, matching the
+// providers' own retry conventions, as are timeouts (context deadline
+// exceeded) and other network errors; SMTP 5xx, HTTP 4xx, and anything else
+// (bad config, a malformed notification) are treated as permanent so a
+// persistently broken notification doesn't retry forever. A DNS failure is
+// permanent (a bad hostname in a static config won't resolve on retry)
+// unless it's a lookup timeout, which usually means a flaky resolver rather
+// than a bad name.
+func isRetriable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code >= 400 && smtpErr.Code < 500
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code >= 500 || statusErr.code == http.StatusTooManyRequests
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return false
+}
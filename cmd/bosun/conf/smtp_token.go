@@ -0,0 +1,60 @@
+package conf
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// TokenSource supplies bearer tokens for SMTP XOAUTH2 authentication. Token
+// returns the current token, minting one on first use; Refresh forces a new
+// token to be fetched, which SendMail calls once if the server rejects the
+// current token with a 4xx auth failure.
+type TokenSource interface {
+	Token() (string, error)
+	Refresh() (string, error)
+}
+
+// StaticTokenSource is a TokenSource backed by a fixed, pre-minted bearer
+// token, e.g. one an operator refreshes out-of-band and drops into config.
+type StaticTokenSource string
+
+func (s StaticTokenSource) Token() (string, error)   { return string(s), nil }
+func (s StaticTokenSource) Refresh() (string, error) { return string(s), nil }
+
+// ExecTokenSource mints bearer tokens by running an external helper command
+// and using its trimmed stdout as the token. This is the usual way to plug
+// Bosun into an OAuth2 client-credentials flow without teaching it about a
+// specific identity provider.
+type ExecTokenSource struct {
+	Command string
+	Args    []string
+
+	mu    sync.Mutex
+	token string
+}
+
+func (e *ExecTokenSource) Token() (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.token != "" {
+		return e.token, nil
+	}
+	return e.refreshLocked()
+}
+
+func (e *ExecTokenSource) Refresh() (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.refreshLocked()
+}
+
+func (e *ExecTokenSource) refreshLocked() (string, error) {
+	out, err := exec.Command(e.Command, e.Args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("xoauth2 token helper %s: %v", e.Command, err)
+	}
+	e.token = strings.TrimSpace(string(out))
+	return e.token, nil
+}
@@ -0,0 +1,94 @@
+// Package web serves Bosun's admin HTTP API.
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"bosun.org/cmd/bosun/conf"
+	"bosun.org/slog"
+)
+
+// RegisterNotificationQueueRoutes wires the admin endpoints for inspecting
+// and managing q onto mux, under the given prefix (e.g.
+// "/api/notifications/queue"):
+//
+//	GET  {prefix}            list queued notifications
+//	POST {prefix}/{id}/retry re-dispatch a queued notification immediately
+//	POST {prefix}/{id}/cancel drop a queued notification without sending it
+func RegisterNotificationQueueRoutes(mux *http.ServeMux, prefix string, q *conf.NotificationQueue) {
+	mux.HandleFunc(prefix, func(w http.ResponseWriter, r *http.Request) {
+		listQueuedNotifications(w, r, q)
+	})
+	mux.HandleFunc(prefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		id, action, ok := parseQueueItemPath(r.URL.Path, prefix)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch action {
+		case "retry":
+			retryQueuedNotification(w, r, q, id)
+		case "cancel":
+			cancelQueuedNotification(w, r, q, id)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// parseQueueItemPath splits "{prefix}/{id}/{action}" into id and action.
+func parseQueueItemPath(path, prefix string) (id, action string, ok bool) {
+	rest := strings.TrimPrefix(path, prefix+"/")
+	if rest == path {
+		return "", "", false
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func listQueuedNotifications(w http.ResponseWriter, r *http.Request, q *conf.NotificationQueue) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	items, err := q.List()
+	if err != nil {
+		slog.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(items); err != nil {
+		slog.Errorln(err)
+	}
+}
+
+func retryQueuedNotification(w http.ResponseWriter, r *http.Request, q *conf.NotificationQueue, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := q.Retry(id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func cancelQueuedNotification(w http.ResponseWriter, r *http.Request, q *conf.NotificationQueue, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := q.Cancel(id); err != nil {
+		slog.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}